@@ -3,7 +3,7 @@ package content_type
 import (
 	"bytes"
 	"errors"
-	"fmt"
+	"math"
 	"net/http"
 	"sort"
 	"strconv"
@@ -14,7 +14,8 @@ import (
 type ContentType struct {
 	MediaType  string            // The full text of the type (ex "application/json")
 	Type       string            // The major type (ex "application")
-	SubType    string            // The sub type (ex "json")
+	SubType    string            // The sub type (ex "vnd.api+json")
+	Suffix     string            // The structured syntax suffix per RFC 6839 (ex "json" in "vnd.api+json"), empty if none
 	Parameters map[string]string // Parameter map of any additional qualities (ex "charset=utf-8"
 	Quality    float64           // The quality type (q=1) in numeric form
 }
@@ -22,20 +23,35 @@ type ContentType struct {
 // ContentTypeList is an array of content type objects
 type ContentTypeList []*ContentType
 
+// HeaderSource abstracts reading a request's headers, so ParseFrom can serve
+// frameworks other than net/http (ex fasthttp) without the core package
+// depending on them. *http.Request's Header already satisfies this.
+type HeaderSource interface {
+	Get(key string) string
+	Values(key string) []string
+}
+
 // ParseRequests pulls content types from the `Content-Type` and `Accept` headers, reconstructing
 // them according to RFC 2616. The return value for content may be nil even if no error was set
 func ParseRequest(r *http.Request) (content *ContentType, accepts ContentTypeList, err error) {
+	return ParseFrom(r.Header)
+}
+
+// ParseFrom pulls content types from the `Content-Type` and `Accept` headers of src,
+// reconstructing them according to RFC 2616. The return value for content may be nil
+// even if no error was set
+func ParseFrom(src HeaderSource) (content *ContentType, accepts ContentTypeList, err error) {
 
 	// The Content-Type should only be a single entry, so we take the first and disregard
 	// any other entries
-	content, err = ParseSingle(r.Header.Get("Content-Type"))
+	content, err = ParseSingle(src.Get("Content-Type"))
 	if err != nil {
 		return
 	}
 
 	// RFC 2616 sec 4.2 allows headers to be split across multiple entries
 	// and specifies they should be reconstructed with a comma separator
-	fullType := strings.Join(r.Header["Accept"], ",")
+	fullType := strings.Join(src.Values("Accept"), ",")
 	accepts, err = Parse(fullType)
 	if err != nil {
 		return
@@ -48,7 +64,7 @@ func ParseRequest(r *http.Request) (content *ContentType, accepts ContentTypeLis
 func Parse(data string) (ContentTypeList, error) {
 	types := make(ContentTypeList, 0, 1)
 
-	for _, entry := range strings.Split(data, ",") {
+	for _, entry := range splitUnquoted(data, ',') {
 		t, err := ParseSingle(entry)
 		if err != nil {
 			return nil, err
@@ -63,6 +79,33 @@ func Parse(data string) (ContentTypeList, error) {
 
 }
 
+// splitUnquoted splits data on sep, treating a `"`-delimited quoted-string
+// span (honoring `\`-escapes within it) as atomic. This keeps a sep byte
+// that appears inside a quoted parameter value, such as the comma in
+// `profile="http://example.com/a,b"`, from being mistaken for the
+// separator between entries.
+func splitUnquoted(data string, sep byte) []string {
+	var parts []string
+	var inQuotes bool
+	start := 0
+
+	for i := 0; i < len(data); i++ {
+		switch {
+		case data[i] == '\\' && inQuotes:
+			// skip the escaped character so it can't toggle quote state
+			i++
+		case data[i] == '"':
+			inQuotes = !inQuotes
+		case data[i] == sep && !inQuotes:
+			parts = append(parts, data[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, data[start:])
+
+	return parts
+}
+
 // ParseSingle takes a single content type and assumes it is not comma terminated
 func ParseSingle(data string) (*ContentType, error) {
 	var qSet bool
@@ -71,36 +114,76 @@ func ParseSingle(data string) (*ContentType, error) {
 		return nil, nil
 	}
 
+	// bare CR/LF is only legal as part of header obs-fold, which the caller
+	// is expected to have already unfolded before reaching us
+	if strings.ContainsAny(data, "\r\n") {
+		return nil, errors.New("Invalid control character in content type [" + data + "]")
+	}
+
 	t := &ContentType{
 		Parameters: make(map[string]string),
 	}
 
-	// split the content type out from it's parameters
-	components := strings.Split(data, ";")
-	t.MediaType = strings.TrimSpace(components[0])
+	p := &mimeParser{data: data}
+
+	p.skipOWS()
+	typ, err := p.token()
+	if err != nil {
+		return nil, errors.New("Invalid content type [" + data + "]")
+	}
+	if !p.consume('/') {
+		return nil, errors.New("Invalid content type [" + data + "]")
+	}
+	subType, err := p.token()
+	if err != nil {
+		return nil, errors.New("Invalid content type [" + data + "]")
+	}
+
+	t.Type = typ
+	t.SubType = subType
+	t.MediaType = typ + "/" + subType
 
-	// split the media type into type and subtype
-	typeParts := strings.Split(t.MediaType, "/")
-	if len(typeParts) != 2 {
-		return nil, errors.New("Invalid content type [" + t.MediaType + "]")
+	// RFC 6839 structured syntax suffix (ex "json" in "vnd.api+json")
+	if idx := strings.LastIndexByte(subType, '+'); idx != -1 {
+		t.Suffix = subType[idx+1:]
 	}
-	t.Type = typeParts[0]
-	t.SubType = typeParts[1]
 
 	// Go through the parameters
-	for _, param := range components[1:] {
-		values := strings.Split(param, "=")
-		if len(values) != 2 {
-			return nil, errors.New("Malformed parameter [" + param + "]")
+	for {
+		p.skipOWS()
+		if p.atEnd() {
+			break
+		}
+		if !p.consume(';') {
+			return nil, errors.New("Invalid content type [" + data + "]")
+		}
+		p.skipOWS()
+
+		key, err := p.token()
+		if err != nil {
+			return nil, errors.New("Malformed parameter in content type [" + data + "]")
+		}
+		if !p.consume('=') {
+			return nil, errors.New("Malformed parameter [" + key + "]")
+		}
+
+		var value string
+		if p.peek() == '"' {
+			value, err = p.quotedString()
+		} else {
+			value, err = p.token()
+		}
+		if err != nil {
+			return nil, errors.New("Malformed parameter [" + key + "]")
 		}
-		key := strings.TrimSpace(values[0])
-		t.Parameters[key] = strings.TrimSpace(values[1])
+
+		t.Parameters[key] = value
 
 		// store quality specially
 		if key == "q" {
-			qual, err := strconv.ParseFloat(t.Parameters[key], 64)
+			qual, err := strconv.ParseFloat(value, 64)
 			if err != nil {
-				return nil, errors.New("Malformed quality [" + t.Parameters[key] + "]")
+				return nil, errors.New("Malformed quality [" + value + "]")
 			}
 			t.Quality = qual
 			qSet = true
@@ -115,20 +198,209 @@ func ParseSingle(data string) (*ContentType, error) {
 	return t, nil
 }
 
+// isTokenChar reports whether c is a valid RFC 7230 `tchar`, and so may
+// appear unquoted in a token such as a media type or parameter name.
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	switch c {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return false
+}
+
+// isCTL reports whether c is an RFC 7230 control character.
+func isCTL(c byte) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+// mimeParser tokenizes a single media type per the RFC 7230 `token` /
+// `quoted-string` grammar used throughout RFC 7231 Sec. 3.1.1.1.
+type mimeParser struct {
+	data string
+	pos  int
+}
+
+func (p *mimeParser) atEnd() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *mimeParser) peek() byte {
+	if p.atEnd() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+// consume advances past c if it is next in the input, reporting whether it did
+func (p *mimeParser) consume(c byte) bool {
+	if p.peek() != c {
+		return false
+	}
+	p.pos++
+	return true
+}
+
+// skipOWS consumes any RFC 7230 optional whitespace (space or tab)
+func (p *mimeParser) skipOWS() {
+	for p.peek() == ' ' || p.peek() == '\t' {
+		p.pos++
+	}
+}
+
+// token consumes a run of one or more tchars
+func (p *mimeParser) token() (string, error) {
+	start := p.pos
+	for isTokenChar(p.peek()) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", errors.New("expected token at position " + strconv.Itoa(start))
+	}
+	return p.data[start:p.pos], nil
+}
+
+// quotedString consumes a `quoted-string`, unescaping any quoted-pairs
+func (p *mimeParser) quotedString() (string, error) {
+	if !p.consume('"') {
+		return "", errors.New("expected quoted string at position " + strconv.Itoa(p.pos))
+	}
+
+	var buf bytes.Buffer
+	for {
+		if p.atEnd() {
+			return "", errors.New("unterminated quoted string")
+		}
+
+		c := p.data[p.pos]
+		switch {
+		case c == '"':
+			p.pos++
+			return buf.String(), nil
+		case c == '\\':
+			p.pos++
+			if p.atEnd() {
+				return "", errors.New("unterminated quoted-pair")
+			}
+			buf.WriteByte(p.data[p.pos])
+			p.pos++
+		case isCTL(c) && c != '\t':
+			return "", errors.New("invalid control character in quoted string")
+		default:
+			buf.WriteByte(c)
+			p.pos++
+		}
+	}
+}
+
 func (t *ContentType) String() string {
 	buf := bytes.NewBufferString(t.MediaType)
-	for key, val := range t.Parameters {
+
+	// q is tracked separately on Quality and emitted last, so it is excluded
+	// here to avoid being duplicated if it is also present in Parameters
+	keys := make([]string, 0, len(t.Parameters))
+	for key := range t.Parameters {
+		if key == "q" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
 		buf.WriteString("; ")
-		buf.WriteString(key + "=" + val)
+		for i := 0; i < len(key); i++ {
+			// control characters are dropped from names for the same
+			// reason quoteIfNeeded drops them from values
+			if !isCTL(key[i]) {
+				buf.WriteByte(key[i])
+			}
+		}
+		buf.WriteString("=")
+		buf.WriteString(quoteIfNeeded(t.Parameters[key]))
 	}
 
 	if t.Quality != 1 {
-		fmt.Fprintf(buf, "; q=%f", t.Quality)
+		buf.WriteString("; q=")
+		buf.WriteString(formatQuality(t.Quality))
 	}
 
 	return buf.String()
 }
 
+// formatQuality renders q in the canonical form required by RFC 7231 Sec.
+// 5.3.1: up to 3 digits after the decimal point, with no trailing zeros.
+func formatQuality(q float64) string {
+	rounded := math.Round(q*1000) / 1000
+	return strconv.FormatFloat(rounded, 'f', -1, 64)
+}
+
+// FormatMediaType formats a media type and its parameters into the same
+// canonical string form as ContentType.String(), so that it round-trips
+// through ParseSingle. A "q" entry in params, if present, is used as the
+// quality; it is otherwise treated as 1. It returns an error if any
+// parameter value contains a control character: those have no valid
+// representation in an RFC 7230 quoted-string, and callers writing the
+// result straight to a response header (ex w.Header().Set("Content-Type", ...))
+// must not have a CR/LF smuggled through silently.
+func FormatMediaType(mediaType string, params map[string]string) (string, error) {
+	for key, val := range params {
+		for i := 0; i < len(val); i++ {
+			if isCTL(val[i]) && val[i] != '\t' {
+				return "", errors.New("invalid control character in parameter [" + key + "]")
+			}
+		}
+	}
+
+	t := &ContentType{
+		MediaType:  mediaType,
+		Parameters: params,
+		Quality:    1,
+	}
+
+	if q, ok := params["q"]; ok {
+		if qual, err := strconv.ParseFloat(q, 64); err == nil {
+			t.Quality = qual
+		}
+	}
+
+	return t.String(), nil
+}
+
+// quoteIfNeeded returns val as-is if it is a valid token, or as an RFC 7230
+// quoted-string (with `"` and `\` escaped) otherwise. Control characters
+// other than HTAB have no valid quoted-string representation, so they are
+// dropped rather than ever written raw, which keeps String() from being
+// able to smuggle a CRLF into a header regardless of how Parameters was
+// populated.
+func quoteIfNeeded(val string) string {
+	needsQuoting := val == ""
+	for i := 0; i < len(val) && !needsQuoting; i++ {
+		needsQuoting = !isTokenChar(val[i])
+	}
+	if !needsQuoting {
+		return val
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(val); i++ {
+		c := val[i]
+		if isCTL(c) && c != '\t' {
+			continue
+		}
+		if c == '"' || c == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(c)
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
 func (l ContentTypeList) String() string {
 	var buf bytes.Buffer
 
@@ -146,50 +418,138 @@ func (l ContentTypeList) String() string {
 	return buf.String()
 }
 
+// Match finds the most specific media range in l that matches option, per RFC
+// 7231 Sec. 5.3.2. It returns the quality associated with that range, a
+// specificity score for it, and whether any range matched at all. It is
+// MatchWith with the zero MatchOptions, so see MatchWith for how specificity
+// is scored.
+func (l ContentTypeList) Match(option *ContentType) (acceptQ float64, specificity int, ok bool) {
+	return l.MatchWith(option, MatchOptions{})
+}
+
 // SupportsType checks if the provided content type t is supported by an entry in this list
 func (l ContentTypeList) SupportsType(t *ContentType) bool {
-	for _, support := range l {
+	_, _, ok := l.Match(t)
+	return ok
+}
+
+// SupportsTypeWith is SupportsType with the optional matching behaviors in
+// opts applied, such as RFC 6839 structured syntax suffix matching.
+func (l ContentTypeList) SupportsTypeWith(t *ContentType, opts MatchOptions) bool {
+	_, _, ok := l.MatchWith(t, opts)
+	return ok
+}
+
+// PreferredMatch chooses the best content type from options based on the
+// quality and specificity of the most specific matching range in l. Ranking
+// is by (quality, specificity, server preference order), where server
+// preference order favors options declared earlier in the list on ties.
+// Returns nil if no options are supported.
+func (l ContentTypeList) PreferredMatch(options ContentTypeList) *ContentType {
+	return l.PreferredMatchWith(options, MatchOptions{})
+}
+
+// MatchOptions configures optional matching behaviors for MatchWith and
+// PreferredMatchWith. The zero value reproduces the strict behavior of
+// Match and PreferredMatch.
+type MatchOptions struct {
+	// StructuredSuffix enables RFC 6839 structured syntax suffix matching,
+	// so that an Accept entry of "application/json" is considered
+	// compatible with an offered "application/vnd.api+json", and vice versa.
+	StructuredSuffix bool
+}
+
+// MatchWith finds the most specific media range in l that matches option,
+// per RFC 7231 Sec. 5.3.2, with the optional matching behaviors in opts
+// applied. It returns the quality associated with that range, a specificity
+// score for it, and whether any range matched at all.
+//
+// Specificity is scored as: a fully specified range (e.g. "text/html")
+// scores 3, a structured-suffix match enabled by opts.StructuredSuffix
+// scores 2, a subtype wildcard ("text/*") scores 1, and the "*/*" wildcard
+// scores 0, with one additional point for each parameter on the range that
+// also matches on option. Ranges with a quality of 0 are treated as
+// explicitly unacceptable and never match.
+func (l ContentTypeList) MatchWith(option *ContentType, opts MatchOptions) (acceptQ float64, specificity int, ok bool) {
+	for _, rng := range l {
 
 		// major type must match
-		if support.Type != "*" && support.Type != t.Type {
+		if rng.Type != "*" && rng.Type != option.Type {
 			continue
 		}
 
-		// sub type must match
-		if support.SubType != "*" && support.SubType != t.SubType {
+		exactMatch := rng.SubType == option.SubType
+		structuredMatch := false
+		if opts.StructuredSuffix && rng.SubType != "*" && !exactMatch {
+			// only bridge a bare type (ex "application/json") with a
+			// suffixed type sharing that same suffix (ex
+			// "application/vnd.api+json"); two different suffixed types
+			// (ex "vnd.github.v3+json" and "vnd.stripe+json") must not
+			// match each other just because they share a suffix
+			structuredMatch = (rng.Suffix == "" && rng.SubType == option.Suffix) ||
+				(option.Suffix == "" && option.SubType == rng.Suffix)
+		}
+
+		if rng.SubType != "*" && !exactMatch && !structuredMatch {
 			continue
 		}
 
 		// quality must not be 0
-		if support.Quality == 0 {
+		if rng.Quality == 0 {
 			continue
 		}
 
-		return true
+		var score int
+		switch {
+		case rng.Type == "*":
+			score = 0
+		case rng.SubType == "*":
+			score = 1
+		case structuredMatch:
+			score = 2
+		default:
+			score = 3
+		}
+
+		for key, val := range rng.Parameters {
+			if key == "q" {
+				continue
+			}
+			if optVal, present := option.Parameters[key]; present && optVal == val {
+				score++
+			}
+		}
+
+		// keep the most specific range seen so far
+		if !ok || score > specificity {
+			acceptQ = rng.Quality
+			specificity = score
+			ok = true
+		}
 	}
 
-	return false
+	return
 }
 
-// PreferredMatch chooses the best content type based on quality that is supported in options from the list.
-// Returns nil if no types are supported.
-func (l ContentTypeList) PreferredMatch(options ContentTypeList) *ContentType {
-	candidates := make(ContentTypeList, 0, len(options))
+// PreferredMatchWith is PreferredMatch with the optional matching behaviors
+// in opts applied, such as RFC 6839 structured syntax suffix matching.
+func (l ContentTypeList) PreferredMatchWith(options ContentTypeList, opts MatchOptions) *ContentType {
+	var best *ContentType
+	var bestQ float64
+	var bestSpecificity int
 
-	// get the list of mutually supported types
 	for _, option := range options {
-		if l.SupportsType(option) {
-			candidates = append(candidates, option)
+		acceptQ, specificity, ok := l.MatchWith(option, opts)
+		if !ok {
+			continue
 		}
-	}
 
-	if len(candidates) == 0 {
-		return nil
+		if best == nil || acceptQ > bestQ || (acceptQ == bestQ && specificity > bestSpecificity) {
+			best = option
+			bestQ = acceptQ
+			bestSpecificity = specificity
+		}
 	}
 
-	sort.SliceStable(candidates, func(i, j int) bool {
-		return candidates[i].Quality < candidates[j].Quality
-	})
-
-	return candidates[len(candidates)-1]
+	return best
 }
@@ -3,6 +3,7 @@ package content_type
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -61,6 +62,46 @@ func TestParseSingle2(t *testing.T) {
 	}
 }
 
+func TestParseSingleQuotedString(t *testing.T) {
+	str := `text/plain; charset="utf-8; weird"`
+
+	ct, err := ParseSingle(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct.Parameters["charset"] != "utf-8; weird" {
+		t.Error("Wrong parameters", ct.Parameters)
+	}
+}
+
+func TestParseSingleQuotedStringEscapes(t *testing.T) {
+	str := `application/vnd.api+json; profile="http://example.com/p\"q\""`
+
+	ct, err := ParseSingle(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct.Parameters["profile"] != `http://example.com/p"q"` {
+		t.Error("Wrong parameters", ct.Parameters)
+	}
+}
+
+func TestParseSingleMalformed(t *testing.T) {
+	if _, err := ParseSingle("text/plain; charset="); err == nil {
+		t.Error("Expected error for malformed parameter")
+	}
+
+	if _, err := ParseSingle("text/plain; charset=\"unterminated"); err == nil {
+		t.Error("Expected error for unterminated quoted string")
+	}
+
+	if _, err := ParseSingle("text\r\n/plain"); err == nil {
+		t.Error("Expected error for embedded CRLF")
+	}
+}
+
 func TestParse(t *testing.T) {
 	str := "text/plain; q=0.5, text/html, text/x-dvi; q=0.8, text/x-c"
 
@@ -82,6 +123,45 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParseQuotedComma(t *testing.T) {
+	str := `application/json;profile="http://example.com/a,b", text/html`
+
+	list, err := Parse(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 2 {
+		t.Fatal("Length mismatch", len(list))
+	}
+
+	if list[0].MediaType != "application/json" {
+		t.Error("Mismatch type", list[0].MediaType, "application/json")
+	}
+
+	if list[0].Parameters["profile"] != "http://example.com/a,b" {
+		t.Error("Mismatch parameters", list[0].Parameters)
+	}
+
+	if list[1].MediaType != "text/html" {
+		t.Error("Mismatch type", list[1].MediaType, "text/html")
+	}
+}
+
+func TestParseRequestQuotedComma(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept", `application/json;profile="http://example.com/a,b", text/html`)
+
+	_, accept, err := ParseRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(accept) != 2 {
+		t.Fatal("Length mismatch", len(accept))
+	}
+}
+
 func TestParseRequest(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
 	req.Header.Add("Accept", "text/plain")
@@ -132,6 +212,40 @@ func TestParseRequest2(t *testing.T) {
 	}
 }
 
+type fakeHeaderSource map[string][]string
+
+func (f fakeHeaderSource) Get(key string) string {
+	values := f[key]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (f fakeHeaderSource) Values(key string) []string {
+	return f[key]
+}
+
+func TestParseFrom(t *testing.T) {
+	src := fakeHeaderSource{
+		"Content-Type": {"application/json"},
+		"Accept":       {"text/plain"},
+	}
+
+	ct, accept, err := ParseFrom(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct == nil || ct.MediaType != "application/json" {
+		t.Error("Mismatch", ct)
+	}
+
+	if len(accept) != 1 || accept[0].MediaType != "text/plain" {
+		t.Error("Mismatch", accept)
+	}
+}
+
 func TestContentTypeList_SupportsType(t *testing.T) {
 	list, err := Parse("text/plain; q=0.5, text/html, text/x-dvi; q=0.8, text/x-c")
 	if err != nil {
@@ -222,3 +336,287 @@ func TestContentTypeList_PreferredMatch3(t *testing.T) {
 		t.Error("Mismatch", match.MediaType, "application/nothing")
 	}
 }
+
+func TestContentTypeList_PreferredMatchSpecificity(t *testing.T) {
+	// all candidates share the same q, so specificity must break the tie
+	list, err := Parse("*/*; q=0.8, text/*; q=0.8, text/html; q=0.8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := Parse("text/plain, text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := list.PreferredMatch(options)
+	if match.MediaType != "text/html" {
+		t.Error("Mismatch", match.MediaType, "text/html")
+	}
+}
+
+func TestContentTypeList_MatchSpecificity(t *testing.T) {
+	list, err := Parse("*/*; q=0.2, text/*; q=0.5, text/html; q=0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	option, err := ParseSingle("text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acceptQ, specificity, ok := list.Match(option)
+	if !ok {
+		t.Fatal("Expected a match")
+	}
+
+	if acceptQ != 0.9 {
+		t.Error("Wrong quality", acceptQ)
+	}
+
+	if specificity != 3 {
+		t.Error("Wrong specificity", specificity)
+	}
+}
+
+func TestParseSingleSuffix(t *testing.T) {
+	ct, err := ParseSingle("application/vnd.api+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct.SubType != "vnd.api+json" {
+		t.Error("Wrong subtype", ct.SubType)
+	}
+
+	if ct.Suffix != "json" {
+		t.Error("Wrong suffix", ct.Suffix)
+	}
+}
+
+func TestParseSingleNoSuffix(t *testing.T) {
+	ct, err := ParseSingle("text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct.Suffix != "" {
+		t.Error("Expected no suffix", ct.Suffix)
+	}
+}
+
+func TestContentTypeList_PreferredMatchWithStructuredSuffix(t *testing.T) {
+	list, err := Parse("application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := Parse("application/vnd.api+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.PreferredMatch(options) != nil {
+		t.Error("Should not match without StructuredSuffix")
+	}
+
+	match := list.PreferredMatchWith(options, MatchOptions{StructuredSuffix: true})
+	if match == nil || match.MediaType != "application/vnd.api+json" {
+		t.Error("Mismatch", match)
+	}
+}
+
+func TestContentTypeList_PreferredMatchWithStructuredSuffixRanking(t *testing.T) {
+	list, err := Parse("application/*, application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := Parse("application/vnd.api+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := list.PreferredMatchWith(options, MatchOptions{StructuredSuffix: true})
+	if match == nil || match.MediaType != "application/vnd.api+json" {
+		t.Error("Mismatch", match)
+	}
+
+	_, specificity, ok := list.MatchWith(options[0], MatchOptions{StructuredSuffix: true})
+	if !ok {
+		t.Fatal("Expected a match")
+	}
+
+	// the structured-suffix match on "application/json" must outrank the
+	// "application/*" wildcard
+	if specificity != 2 {
+		t.Error("Wrong specificity", specificity)
+	}
+}
+
+func TestContentTypeList_PreferredMatchWithStructuredSuffixDistinctVendors(t *testing.T) {
+	// two different vendor trees sharing a "+json" suffix must not match
+	// each other; only bare type <-> suffixed type bridging is allowed
+	list, err := Parse("application/vnd.github.v3+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := Parse("application/vnd.stripe+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	match := list.PreferredMatchWith(options, MatchOptions{StructuredSuffix: true})
+	if match != nil {
+		t.Error("Should not have matched distinct vendor trees", match)
+	}
+}
+
+func TestContentTypeList_SupportsTypeWith(t *testing.T) {
+	list, err := Parse("application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target, err := ParseSingle("application/vnd.api+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if list.SupportsTypeWith(target, MatchOptions{}) {
+		t.Error("Should not have supported application/vnd.api+json without StructuredSuffix")
+	}
+
+	if !list.SupportsTypeWith(target, MatchOptions{StructuredSuffix: true}) {
+		t.Error("Should have supported application/vnd.api+json with StructuredSuffix")
+	}
+}
+
+func TestContentTypeList_MatchNoMatch(t *testing.T) {
+	list, err := Parse("text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	option, err := ParseSingle("application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, ok := list.Match(option)
+	if ok {
+		t.Error("Should not have matched")
+	}
+}
+
+func TestContentTypeString(t *testing.T) {
+	ct, err := ParseSingle("text/html; q=0.5; charset=utf-8; level=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deterministic parameter ordering, single canonical q, 1 fractional digit
+	if ct.String() != "text/html; charset=utf-8; level=1; q=0.5" {
+		t.Error("Mismatch", ct.String())
+	}
+}
+
+func TestContentTypeStringDefaultQualityOmitted(t *testing.T) {
+	ct, err := ParseSingle("text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct.String() != "text/html" {
+		t.Error("Mismatch", ct.String())
+	}
+}
+
+func TestContentTypeStringQuotesTspecials(t *testing.T) {
+	ct, err := ParseSingle(`text/plain; charset="utf-8; weird"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct.String() != `text/plain; charset="utf-8; weird"` {
+		t.Error("Mismatch", ct.String())
+	}
+}
+
+func TestFormatMediaType(t *testing.T) {
+	str, err := FormatMediaType("text/html", map[string]string{"charset": "utf-8", "q": "0.333333"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ct, err := ParseSingle(str)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct.MediaType != "text/html" {
+		t.Error("Mismatch", ct.MediaType)
+	}
+
+	if ct.Parameters["charset"] != "utf-8" {
+		t.Error("Mismatch", ct.Parameters)
+	}
+
+	if ct.Quality != 0.333 {
+		t.Error("Wrong quality", ct.Quality)
+	}
+}
+
+func TestFormatMediaTypeRejectsControlCharacters(t *testing.T) {
+	_, err := FormatMediaType("text/html", map[string]string{"x": "a\r\nSet-Cookie: evil=1"})
+	if err == nil {
+		t.Error("Expected an error for a parameter containing CRLF")
+	}
+}
+
+func TestContentTypeStringDropsControlCharacters(t *testing.T) {
+	// String() can never return an error (it satisfies fmt.Stringer), so as
+	// a last line of defense against a Parameters map built without going
+	// through FormatMediaType, it must not emit raw control characters
+	// even if asked to
+	ct := &ContentType{
+		MediaType:  "text/html",
+		Parameters: map[string]string{"x": "a\r\nSet-Cookie: evil=1"},
+		Quality:    1,
+	}
+
+	if strings.ContainsAny(ct.String(), "\r\n") {
+		t.Error("String() must not emit raw CR/LF", ct.String())
+	}
+}
+
+func FuzzFormatMediaTypeRoundTrip(f *testing.F) {
+	f.Add("html", "utf-8")
+	f.Add("vnd.api+json", `has "quotes" and \backslashes\`)
+
+	f.Fuzz(func(t *testing.T, subtype, charset string) {
+		if subtype == "" {
+			t.Skip()
+		}
+
+		str, err := FormatMediaType("text/"+subtype, map[string]string{"charset": charset})
+		if err != nil {
+			// the fuzzer found a charset with a control character, which
+			// FormatMediaType correctly refuses to format
+			t.Skip()
+		}
+
+		ct, err := ParseSingle(str)
+		if err != nil {
+			// not every fuzzed subtype is a valid token; only round-trip
+			// is guaranteed for inputs ParseSingle itself accepts
+			t.Skip()
+		}
+
+		if ct.Parameters["charset"] != charset {
+			t.Errorf("round-trip mismatch: got %q, want %q", ct.Parameters["charset"], charset)
+		}
+	})
+}
@@ -0,0 +1,43 @@
+// Package fasthttp adapts *fasthttp.RequestCtx to the content_type package,
+// so the same negotiation logic can serve fasthttp-based servers without the
+// core package importing fasthttp.
+package fasthttp
+
+import (
+	"github.com/valyala/fasthttp"
+
+	content_type "github.com/AndrewBurian/content-type"
+)
+
+// RequestCtxSource adapts a *fasthttp.RequestCtx's request headers to
+// content_type.HeaderSource.
+type RequestCtxSource struct {
+	Ctx *fasthttp.RequestCtx
+}
+
+// Get returns the first value of the named request header.
+func (s RequestCtxSource) Get(key string) string {
+	return string(s.Ctx.Request.Header.Peek(key))
+}
+
+// Values returns all values of the named request header. fasthttp keeps
+// repeated headers separate rather than folding them, so this uses PeekAll
+// rather than Peek (which only sees the first).
+func (s RequestCtxSource) Values(key string) []string {
+	raw := s.Ctx.Request.Header.PeekAll(key)
+	if len(raw) == 0 {
+		return nil
+	}
+
+	values := make([]string, len(raw))
+	for i, v := range raw {
+		values[i] = string(v)
+	}
+	return values
+}
+
+// ParseRequest pulls content types from ctx's request headers, reconstructing
+// them according to RFC 2616. See content_type.ParseFrom.
+func ParseRequest(ctx *fasthttp.RequestCtx) (content *content_type.ContentType, accepts content_type.ContentTypeList, err error) {
+	return content_type.ParseFrom(RequestCtxSource{Ctx: ctx})
+}
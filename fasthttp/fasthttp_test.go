@@ -0,0 +1,48 @@
+package fasthttp
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRequestCtxSourceValuesRepeatedHeader(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.Add("Accept", "text/plain")
+	ctx.Request.Header.Add("Accept", "text/html")
+
+	src := RequestCtxSource{Ctx: &ctx}
+
+	values := src.Values("Accept")
+	if len(values) != 2 {
+		t.Fatalf("Expected 2 values, got %d: %v", len(values), values)
+	}
+
+	if values[0] != "text/plain" || values[1] != "text/html" {
+		t.Error("Mismatch", values)
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	var ctx fasthttp.RequestCtx
+	ctx.Request.Header.Set("Content-Type", "application/json")
+	ctx.Request.Header.Add("Accept", "text/plain")
+	ctx.Request.Header.Add("Accept", "text/html")
+
+	content, accepts, err := ParseRequest(&ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content == nil || content.MediaType != "application/json" {
+		t.Error("Mismatch", content)
+	}
+
+	if len(accepts) != 2 {
+		t.Fatalf("Expected 2 accept entries, got %d", len(accepts))
+	}
+
+	if accepts[0].MediaType != "text/plain" || accepts[1].MediaType != "text/html" {
+		t.Error("Mismatch", accepts)
+	}
+}
@@ -0,0 +1,151 @@
+package content_type
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// errNotAcceptable is returned by Negotiate when no offer satisfies the
+// request's Accept header.
+var errNotAcceptable = errors.New("content_type: no offer is acceptable to the client")
+
+type contextKey int
+
+const (
+	outboundTypeKey contextKey = iota
+	inboundTypeKey
+)
+
+// Negotiator wraps a fixed set of server-declared offers and performs content
+// negotiation against incoming requests, to save callers from re-implementing
+// the ParseRequest + PreferredMatch dance themselves.
+type Negotiator struct {
+	offers        ContentTypeList
+	acceptedInput ContentTypeList
+}
+
+// NewNegotiator builds a Negotiator from the server's offered representations,
+// given in preference order (ex NewNegotiator("application/json", "text/html; q=0.9")).
+func NewNegotiator(offers ...string) (*Negotiator, error) {
+	list := make(ContentTypeList, 0, len(offers))
+
+	for _, offer := range offers {
+		t, err := ParseSingle(offer)
+		if err != nil {
+			return nil, err
+		}
+		if t != nil {
+			list = append(list, t)
+		}
+	}
+
+	return &Negotiator{offers: list}, nil
+}
+
+// AcceptInput restricts the request bodies n.Middleware will accept. If set,
+// requests whose Content-Type does not match one of types are rejected with
+// 415 Unsupported Media Type before reaching the wrapped handler.
+func (n *Negotiator) AcceptInput(types ...string) error {
+	list, err := Parse(joinComma(types))
+	if err != nil {
+		return err
+	}
+
+	n.acceptedInput = list
+	return nil
+}
+
+// joinComma reconstructs a single comma separated header value from discrete
+// entries, the same way repeated header lines are joined in ParseRequest.
+func joinComma(entries []string) string {
+	result := ""
+	for i, e := range entries {
+		if i > 0 {
+			result += ","
+		}
+		result += e
+	}
+	return result
+}
+
+// Negotiate parses r's Accept header and returns the best offer for it.
+// It returns errNotAcceptable if no offer is acceptable to the client.
+func (n *Negotiator) Negotiate(r *http.Request) (*ContentType, error) {
+	_, accepts, err := ParseRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	match := n.bestOffer(accepts)
+	if match == nil {
+		return nil, errNotAcceptable
+	}
+
+	return match, nil
+}
+
+// bestOffer picks the best of n.offers for the given Accept list. A missing
+// or empty Accept header means any type is acceptable (RFC 7231 Sec. 5.3.2),
+// so the first, most preferred offer is used.
+func (n *Negotiator) bestOffer(accepts ContentTypeList) *ContentType {
+	if len(accepts) == 0 {
+		if len(n.offers) == 0 {
+			return nil
+		}
+		return n.offers[0]
+	}
+
+	return accepts.PreferredMatch(n.offers)
+}
+
+// Middleware negotiates a response type for every request before calling
+// next, writing the result to the Content-Type header. It responds with
+// 406 Not Acceptable if no offer satisfies the request's Accept header, or
+// 415 Unsupported Media Type if the request body's Content-Type is not
+// accepted per AcceptInput. The negotiated outbound type and the parsed
+// inbound type are stashed on the request context, retrievable with
+// NegotiatedType and RequestType.
+func (n *Negotiator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, accepts, err := ParseRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if content != nil && len(n.acceptedInput) > 0 && !n.acceptedInput.SupportsType(content) {
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		match := n.bestOffer(accepts)
+		if match == nil {
+			http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+			return
+		}
+
+		w.Header().Set("Content-Type", match.String())
+
+		ctx := context.WithValue(r.Context(), outboundTypeKey, match)
+		if content != nil {
+			ctx = context.WithValue(ctx, inboundTypeKey, content)
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// NegotiatedType returns the outbound content type a Negotiator's Middleware
+// chose for r, if any.
+func NegotiatedType(r *http.Request) (*ContentType, bool) {
+	t, ok := r.Context().Value(outboundTypeKey).(*ContentType)
+	return t, ok
+}
+
+// RequestType returns the inbound request's parsed Content-Type, as stashed
+// by a Negotiator's Middleware, if any.
+func RequestType(r *http.Request) (*ContentType, bool) {
+	t, ok := r.Context().Value(inboundTypeKey).(*ContentType)
+	return t, ok
+}
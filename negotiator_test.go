@@ -0,0 +1,140 @@
+package content_type
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewNegotiator(t *testing.T) {
+	n, err := NewNegotiator("application/json", "text/html; q=0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(n.offers) != 2 {
+		t.Fatal("Wrong number of offers", len(n.offers))
+	}
+}
+
+func TestNegotiatorNegotiate(t *testing.T) {
+	n, err := NewNegotiator("application/json", "text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept", "text/html")
+
+	match, err := n.Negotiate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if match.MediaType != "text/html" {
+		t.Error("Mismatch", match.MediaType, "text/html")
+	}
+}
+
+func TestNegotiatorNegotiateNotAcceptable(t *testing.T) {
+	n, err := NewNegotiator("application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept", "text/html")
+
+	if _, err := n.Negotiate(req); err == nil {
+		t.Error("Expected a not-acceptable error")
+	}
+}
+
+func TestNegotiatorMiddleware(t *testing.T) {
+	n, err := NewNegotiator("application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotType *ContentType
+	handler := n.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotType, _ = NegotiatedType(r)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept", "application/json")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Error("Wrong Content-Type header", rec.Header().Get("Content-Type"))
+	}
+
+	if gotType == nil || gotType.MediaType != "application/json" {
+		t.Error("Wrong negotiated type", gotType)
+	}
+}
+
+func TestNegotiatorMiddlewareNotAcceptable(t *testing.T) {
+	n, err := NewNegotiator("application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := n.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler should not have been called")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Accept", "text/html")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotAcceptable {
+		t.Error("Wrong status code", rec.Code)
+	}
+}
+
+func TestNegotiatorMiddlewareUnsupportedMediaType(t *testing.T) {
+	n, err := NewNegotiator("application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.AcceptInput("application/json"); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := n.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler should not have been called")
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/xml")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnsupportedMediaType {
+		t.Error("Wrong status code", rec.Code)
+	}
+}
+
+func TestNegotiatorAcceptInputQuotedComma(t *testing.T) {
+	n, err := NewNegotiator("application/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.AcceptInput(`application/json;profile="http://example.com/a,b"`, "text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(n.acceptedInput) != 2 {
+		t.Fatal("Length mismatch", len(n.acceptedInput))
+	}
+}